@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// acmeSecret authenticates /dns/acme/present and /dns/acme/cleanup via a
+// bearer token. Left empty, both endpoints refuse every request.
+var acmeSecret string
+
+func authorizeACME(r *http.Request) bool {
+	if acmeSecret == "" {
+		return false
+	}
+	return r.Header.Get("Authorization") == "Bearer "+acmeSecret
+}
+
+// acmeChallenge is the body lego/certbot's webhook/httpreq DNS-01
+// provider sends to present or clean up a `_acme-challenge.*` TXT record.
+type acmeChallenge struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+// acmePresentHandler installs the challenge TXT value in z so the next
+// authoritative TXT query for FQDN answers it.
+func acmePresentHandler(z *Zone, ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeACME(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var c acmeChallenge
+		defer r.Body.Close()
+		if e := json.NewDecoder(r.Body).Decode(&c); e != nil || c.FQDN == "" || c.Value == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		z.Present(c.FQDN, c.Value, ttl)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// acmeCleanupHandler removes a previously presented challenge TXT value.
+func acmeCleanupHandler(z *Zone) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeACME(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var c acmeChallenge
+		defer r.Body.Close()
+		if e := json.NewDecoder(r.Body).Decode(&c); e != nil || c.FQDN == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		z.Cleanup(c.FQDN)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
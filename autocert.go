@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// meteringCache wraps an autocert.Cache and counts autocertRequestsTotal
+// each time a certificate is actually obtained or renewed (i.e. newly
+// written to the cache) -- unlike hooking tls.Config.GetCertificate,
+// which fires on every TLS handshake regardless of whether autocert did
+// any work. The ACME account key, which autocert stores in the same
+// cache, is not counted.
+type meteringCache struct {
+	autocert.Cache
+}
+
+func (c meteringCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(key, "acme_account") {
+		autocertRequestsTotal.Inc()
+	}
+	return nil
+}
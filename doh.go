@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// dohHandler implements RFC 8484: a POST carrying a raw DNS message as the
+// body (Content-Type: application/dns-message), or a GET with the message
+// base64url-encoded in the "dns" query parameter. Either way the decoded
+// query's domain is recorded against the requester's IP through h, exactly
+// like a classic UDP/TCP query.
+func dohHandler(h *Handle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+
+		switch r.Method {
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "unsupported content-type", http.StatusUnsupportedMediaType)
+				return
+			}
+			defer r.Body.Close()
+			buf, err = ioutil.ReadAll(io.LimitReader(r.Body, 65535))
+		case http.MethodGet:
+			q := r.URL.Query().Get("dns")
+			if q == "" {
+				http.Error(w, "missing dns parameter", http.StatusBadRequest)
+				return
+			}
+			buf, err = base64.RawURLEncoding.DecodeString(q)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed reading query", http.StatusBadRequest)
+			return
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			http.Error(w, "failed unpacking query", http.StatusBadRequest)
+			return
+		}
+
+		var resp *dns.Msg
+		var ok bool
+		if h.Zone != nil {
+			resp, ok = h.Zone.Answer(req)
+		}
+		if ok {
+			recordQueryMetric(h.Transport, resp.Rcode)
+		} else {
+			ipStr, portStr, _ := net.SplitHostPort(r.RemoteAddr)
+			port, _ := strconv.Atoi(portStr)
+			h.record(ipStr, port, req)
+
+			resp = new(dns.Msg)
+			resp.SetReply(req)
+		}
+
+		packed, e := resp.Pack()
+		if e != nil {
+			http.Error(w, "failed packing reply", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}
+}
+
+// dohMux wraps mux so that only requests addressed to the DoH subdomain
+// (host) are routed to dohHandler; everything else falls through to mux
+// unchanged. This lets the DoH endpoint live on the same http.Server as
+// the rest of the API without claiming a fixed path on the main host.
+func dohMux(mux *http.ServeMux, host string, h *Handle) http.Handler {
+	doh := dohHandler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reqHost, _, err := net.SplitHostPort(r.Host); (err == nil && reqHost == host) || r.Host == host {
+			doh(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
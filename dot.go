@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/miekg/dns"
+)
+
+// startDoT starts a DNS-over-TLS (RFC 7858) listener on addr using the
+// given TLS config, dispatching queries to handler exactly like the plain
+// tcp/udp listeners in main, and returns immediately. The returned
+// *dns.Server lets the caller drain it on shutdown via ShutdownContext.
+func startDoT(addr string, tlsConfig *tls.Config, handler dns.Handler) *dns.Server {
+	srv := &dns.Server{
+		Addr:      addr,
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		Handler:   handler,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			logger.Error("dot_server_failed", "error", err.Error())
+		}
+	}()
+	return srv
+}
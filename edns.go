@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ednsInfo is what can be learned from a query's EDNS0 OPT record: the
+// client subnet (RFC 7871) the recursive resolver forwarded towards the
+// authoritative, the DNSSEC OK bit, and any EDNS cookie (RFC 7873).
+type ednsInfo struct {
+	ECS      string
+	DNSSECOk bool
+	Cookie   string
+}
+
+// parseEDNS extracts ednsInfo from req's OPT record. A query with no
+// EDNS0 OPT record (the common case for plain stub resolvers) yields the
+// zero value.
+func parseEDNS(req *dns.Msg) ednsInfo {
+	var info ednsInfo
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return info
+	}
+	info.DNSSECOk = opt.Do()
+
+	for _, o := range opt.Option {
+		switch v := o.(type) {
+		case *dns.EDNS0_SUBNET:
+			info.ECS = fmt.Sprintf("%s/%d", v.Address, v.SourceNetmask)
+		case *dns.EDNS0_COOKIE:
+			info.Cookie = v.Cookie
+		}
+	}
+
+	return info
+}
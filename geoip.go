@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+var (
+	dbASN     atomic.Pointer[geoip2.Reader]
+	dbCountry atomic.Pointer[geoip2.Reader]
+)
+
+// geoipCloseDelay is how long a replaced reader stays open after a reload.
+const geoipCloseDelay = time.Minute
+
+// loadGeoIP opens both MaxMind databases and atomically swaps them into
+// dbASN/dbCountry. The readers they replace are closed geoipCloseDelay
+// later, so a lookup that loaded one just before the swap can finish with
+// it instead of running against a closed reader.
+func loadGeoIP(asnPath, countryPath string) error {
+	asn, err := geoip2.Open(asnPath)
+	if err != nil {
+		return err
+	}
+
+	country, err := geoip2.Open(countryPath)
+	if err != nil {
+		asn.Close()
+		return err
+	}
+
+	if old := dbASN.Swap(asn); old != nil {
+		time.AfterFunc(geoipCloseDelay, func() { old.Close() })
+	}
+	if old := dbCountry.Swap(country); old != nil {
+		time.AfterFunc(geoipCloseDelay, func() { old.Close() })
+	}
+	return nil
+}
+
+// closeGeoIP closes whatever readers are currently loaded.
+func closeGeoIP() {
+	if r := dbASN.Load(); r != nil {
+		r.Close()
+	}
+	if r := dbCountry.Load(); r != nil {
+		r.Close()
+	}
+}
+
+// watchGeoIPReload reopens the MaxMind databases on every SIGHUP, so a
+// weekly MaxMind update can be picked up with `systemctl reload` instead
+// of a full restart that would lose the in-memory cache this server used
+// to keep.
+func watchGeoIPReload(asnPath, countryPath string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := loadGeoIP(asnPath, countryPath); err != nil {
+			logger.Error("geoip_reload_failed", "error", err.Error())
+			continue
+		}
+		logger.Info("geoip_reloaded")
+	}
+}
@@ -2,70 +2,174 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"github.com/coreos/go-systemd/daemon"
-	ttl_map "github.com/leprosus/golang-ttl-map"
 	"github.com/miekg/dns"
-	geoip2 "github.com/oschwald/geoip2-golang"
 	"golang.org/x/crypto/acme/autocert"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 )
 
 var (
 	Verbose bool
-	cache   ttl_map.Heap
-	dbASN   *geoip2.Reader
-	dbCountry  *geoip2.Reader
+	store   *Store
 )
 
+// HTTP timeouts applied to every http.Server this process runs (plain
+// autocert HTTP-01 responder, metrics, and the public HTTPS API) so none
+// of them is Slowloris-able just because it isn't the main API listener.
+const (
+	httpReadTimeout       = 10 * time.Second
+	httpReadHeaderTimeout = 5 * time.Second
+	httpWriteTimeout      = 10 * time.Second
+	httpIdleTimeout       = 120 * time.Second
+)
+
+// Handle records DNS queries for a single transport into Store. A separate
+// Handle (sharing the same Store) is used per transport so observations
+// carry the right Transport label. If Zone is set, queries Zone.Answer
+// handles (SOA/NS for host and its subdomains; A, TXT and NODATA replies
+// only in the cases Zone.Answer describes) are answered authoritatively
+// instead of being recorded as a leak sample.
 type Handle struct {
+	Store     *Store
+	Transport string
+	Zone      *Zone
 }
 
 func (h *Handle) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	ip := ""
+	port := 0
 	if addr, ok := w.RemoteAddr().(*net.UDPAddr); ok {
 		ip = addr.IP.String()
+		port = addr.Port
 	}
 	if addr, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		ip = addr.IP.String()
+		port = addr.Port
 	}
 	if ip == "" {
 		panic("IP not found?")
 	}
 
+	if h.Zone != nil {
+		if resp, ok := h.Zone.Answer(req); ok {
+			recordQueryMetric(h.Transport, resp.Rcode)
+			w.WriteMsg(resp)
+			return
+		}
+	}
+
+	h.record(ip, port, req)
+}
+
+// record stores a single observation of req being received from ip/port
+// over h.Transport, keyed by the session token embedded in the queried
+// domain's first label. A query with no question section is dropped: it
+// carries no domain to record and dns.Server does not recover handler
+// panics, so an attacker-controlled message that reached this far over
+// DoT or DoH could otherwise crash the process.
+func (h *Handle) record(ip string, port int, req *dns.Msg) {
+	if len(req.Question) == 0 {
+		return
+	}
 	domain := req.Question[0].Name
 	domain = domain[:len(domain)-1]
-	if Verbose {
-		fmt.Printf("Origin=%s\n", ip)
-		fmt.Printf("Domain=%s\n", domain)
+
+	recordQueryMetric(h.Transport, noReplyRcode)
+
+	token := tokenFromDomain(domain)
+	if token == "" {
+		return
 	}
-	ips := cache.Get(domain)
-	ips += "," + ip
-	cache.Set(domain, ips, 300) // 5min
-}
 
-type Domains struct {
-	Domain []string
+	q := req.Question[0]
+	info := parseEDNS(req)
+
+	if asn := dbASN.Load(); asn != nil {
+		if isp, err := asn.ASN(net.ParseIP(ip)); err == nil {
+			asnSeen.observe(isp.AutonomousSystemNumber)
+		}
+	}
+
+	logger.Debug("dns_query",
+		"token", token,
+		"domain", domain,
+		"transport", h.Transport,
+		"source_ip", ip,
+		"source_port", port,
+		"qtype", dns.TypeToString[q.Qtype],
+		"qclass", dns.ClassToString[q.Qclass],
+		"dnssec_ok", info.DNSSECOk,
+		"ecs", info.ECS,
+		"truncated", req.Truncated,
+	)
+
+	if err := h.Store.Record(Observation{
+		Token:      token,
+		Domain:     domain,
+		SourceIP:   ip,
+		SourcePort: port,
+		Transport:  h.Transport,
+		QType:      dns.TypeToString[q.Qtype],
+		QClass:     dns.ClassToString[q.Qclass],
+		DNSSECOk:   info.DNSSECOk,
+		Cookie:     info.Cookie,
+		ECS:        info.ECS,
+		Truncated:  req.Truncated,
+		Timestamp:  time.Now(),
+	}); err != nil {
+		logger.Error("store_record_failed", "error", err.Error())
+	}
 }
-type ResDomain struct {
-	Domain string
-	Origin string
+
+// TokenRequest is the body of a /dns/leaktest lookup: the session token the
+// client embedded in the subdomains it queried.
+type TokenRequest struct {
+	Token string
 }
 
+// Response describes a single DNS observation made for a session token.
+// IP/Country/ISP describe the resolver that reached us; ECS is the client
+// subnet (RFC 7871), if any, that same resolver forwarded towards us on
+// behalf of its own client -- comparing the two is what lets a user tell
+// "my resolver is Google but it leaked my /24 via ECS" from "my resolver
+// hid my subnet".
 type Response struct {
-	ISP     string
-	Country string
-	IP      string
+	Domain     string
+	IP         string
+	Port       int
+	ISP        string
+	Country    string
+	Transport  string
+	QType      string
+	QClass     string
+	DNSSECOk   bool
+	Cookie     string
+	ECS        string
+	Truncated  bool
+	Timestamp  time.Time
 }
 
 func lookup(w http.ResponseWriter, r *http.Request) {
-	var d Domains
+	start := time.Now()
+	status := http.StatusOK
+	defer func() {
+		lookupDuration.WithLabelValues(strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	}()
+	fail := func(code int, msg string) {
+		status = code
+		http.Error(w, msg, code)
+	}
+
+	var req TokenRequest
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,OPTIONS,POST,PUT")
@@ -77,66 +181,67 @@ func lookup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer r.Body.Close()
-	if e := json.NewDecoder(r.Body).Decode(&d); e != nil {
-		log.Printf(e.Error())
-		http.Error(w, "failed decoding input", 400)
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		logger.Error("lookup_decode_failed", "error", e.Error())
+		fail(400, "failed decoding input")
 		return
 	}
-	if Verbose {
-		fmt.Printf("In=%+v\n", d)
+	if req.Token == "" {
+		fail(400, "missing token")
+		return
 	}
 
-	// Filter out duplicate IPs
-	uniqips := make(map[string]int)
-	for _, domain := range d.Domain {
-		vals := cache.Get(domain)
-		for _, ip := range strings.Split(vals, ",") {
-			n, _ := uniqips[ip]
-			uniqips[ip] = n + 1
-		}
+	obs, e := store.Observations(req.Token)
+	if e != nil {
+		logger.Error("lookup_store_failed", "error", e.Error())
+		fail(500, "failed reading observations")
+		return
 	}
 
-	out := make(map[uint]Response)
-	// Humanize
-	for ipstr, _ := range uniqips {
-		if len(ipstr) == 0 {
-			break
-		}
-		// Convert IPs to company list
-		ip := net.ParseIP(ipstr)
-		country, e := dbCountry.Country(ip)
+	out := make([]Response, 0, len(obs))
+	for _, o := range obs {
+		// Convert IP to company/country
+		ip := net.ParseIP(o.SourceIP)
+		country, e := dbCountry.Load().Country(ip)
 		if e != nil {
-			log.Printf("dbCountry=" + e.Error())
-			http.Error(w, "failed parsing IPs", 400)
+			logger.Error("lookup_geoip_failed", "db", "country", "error", e.Error())
+			fail(400, "failed parsing IPs")
 			return
 		}
 
-		isp, e := dbASN.ASN(ip)
+		isp, e := dbASN.Load().ASN(ip)
 		if e != nil {
-			log.Printf("dbASN=" + e.Error())
-			http.Error(w, "failed parsing IPs", 400)
+			logger.Error("lookup_geoip_failed", "db", "asn", "error", e.Error())
+			fail(400, "failed parsing IPs")
 			return
 		}
 
-		if _, ok := out[isp.AutonomousSystemNumber]; !ok {
-			out[isp.AutonomousSystemNumber] = Response{
-				ISP:     isp.AutonomousSystemOrganization,
-				Country: country.Country.IsoCode,
-				IP:      ipstr,
-			}
-		}
-
+		out = append(out, Response{
+			Domain:    o.Domain,
+			IP:        o.SourceIP,
+			Port:      o.SourcePort,
+			ISP:       isp.AutonomousSystemOrganization,
+			Country:   country.Country.IsoCode,
+			Transport: o.Transport,
+			QType:     o.QType,
+			QClass:    o.QClass,
+			DNSSECOk:  o.DNSSECOk,
+			Cookie:    o.Cookie,
+			ECS:       o.ECS,
+			Truncated: o.Truncated,
+			Timestamp: o.Timestamp,
+		})
 	}
 
 	buf := new(bytes.Buffer)
 	if e := json.NewEncoder(buf).Encode(out); e != nil {
-		log.Printf(e.Error())
-		http.Error(w, "failed encoding", 400)
+		logger.Error("lookup_encode_failed", "error", e.Error())
+		fail(400, "failed encoding")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if _, e := w.Write(buf.Bytes()); e != nil {
-		log.Printf(e.Error())
+		logger.Error("lookup_write_failed", "error", e.Error())
 	}
 }
 
@@ -146,57 +251,165 @@ func main() {
 		http_addr string
 		https_addr string
 		host string
+		doh bool
+		doh_label string
+		dot bool
+		dot_addr string
+		db_path string
+		acme bool
+		acme_ip string
+		acme_ttl time.Duration
+		metrics_addr string
+		asn_db string
+		country_db string
+		shutdown_grace time.Duration
 	)
 	flag.BoolVar(&Verbose, "v", false, "Verbose-mode (log more)")
 	flag.StringVar(&dns_addr, "d", "[::]:53", "DNS listen on (both tcp and udp)")
 	flag.StringVar(&http_addr, "h", "[::]:80", "HTTP listen on")
 	flag.StringVar(&https_addr, "s", "[::]:443", "HTTPS listen on")
 	flag.StringVar(&host, "m", "ns-dnstest.spyoff.com", "HTTPS-domain (LetsEncrypt)")
+	flag.BoolVar(&doh, "doh", false, "Also accept DNS-over-HTTPS queries on <doh-label>.dnstest.<host>")
+	flag.StringVar(&doh_label, "doh-label", "doh", "Stable label the DoH endpoint is mounted under (<doh-label>.dnstest.<host>); keep this fixed across restarts so the endpoint and its autocert certificate don't change")
+	flag.BoolVar(&dot, "dot", false, "Also accept DNS-over-TLS queries")
+	flag.StringVar(&dot_addr, "dot-addr", "[::]:853", "DoT listen on (tcp, tls)")
+	flag.StringVar(&db_path, "db", "/tmp/leak.db", "SQLite database to persist observations in")
+	flag.BoolVar(&acme, "acme", false, "Act as authoritative nameserver for host and relay ACME DNS-01 challenges")
+	flag.StringVar(&acme_ip, "acme-ip", "", "IP to answer authoritative A queries with (empty disables A answers)")
+	flag.DurationVar(&acme_ttl, "acme-ttl", 120*time.Second, "How long a presented ACME TXT challenge stays valid")
+	flag.StringVar(&acmeSecret, "acme-secret", "", "Bearer token required by /dns/acme/present and /dns/acme/cleanup")
+	flag.StringVar(&metrics_addr, "metrics-addr", "", "Bind /metrics on this address, separate from the public HTTPS listener (empty disables it)")
+	flag.StringVar(&asn_db, "asn-db", "asn.mmdb", "MaxMind ASN database (reloaded on SIGHUP)")
+	flag.StringVar(&country_db, "country-db", "country.mmdb", "MaxMind country database (reloaded on SIGHUP)")
+	flag.DurationVar(&shutdown_grace, "shutdown-grace", 10*time.Second, "How long to let in-flight requests finish on SIGINT/SIGTERM")
 	flag.Parse()
 
-	handler := &Handle{}
-	cache = ttl_map.New("/tmp/leak.tsv")
+	if Verbose {
+		logLevel.Set(slog.LevelDebug)
+	}
 
 	var err error
-	dbCountry, err = geoip2.Open("country.mmdb")
+	store, err = NewStore(db_path)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer dbCountry.Close()
+	defer store.Close()
 
-	dbASN, err = geoip2.Open("asn.mmdb")
-	if err != nil {
+	var zone *Zone
+	if acme {
+		zone = NewZone(host, net.ParseIP(acme_ip))
+	}
+
+	udpHandler := &Handle{Store: store, Transport: "UDP", Zone: zone}
+	tcpHandler := &Handle{Store: store, Transport: "TCP", Zone: zone}
+
+	if err := loadGeoIP(asn_db, country_db); err != nil {
 		log.Fatal(err)
 	}
-	defer dbASN.Close()
+	defer closeGeoIP()
+	go watchGeoIPReload(asn_db, country_db)
 
+	udpServer := &dns.Server{Addr: dns_addr, Net: "udp", Handler: udpHandler}
+	tcpServer := &dns.Server{Addr: dns_addr, Net: "tcp", Handler: tcpHandler}
 	go func() {
-		if err := dns.ListenAndServe(dns_addr, "udp", handler); err != nil {
-			panic(err)
+		if err := udpServer.ListenAndServe(); err != nil {
+			logger.Error("dns_udp_server_failed", "error", err.Error())
 		}
 	}()
 	go func() {
-		if err := dns.ListenAndServe(dns_addr, "tcp", handler); err != nil {
-			panic(err)
+		if err := tcpServer.ListenAndServe(); err != nil {
+			logger.Error("dns_tcp_server_failed", "error", err.Error())
 		}
 	}()
 
+	whitelist := []string{host}
+	dohHost := ""
+	if doh {
+		dohHost = dohSubdomain(host, doh_label)
+		whitelist = append(whitelist, dohHost)
+		if zone != nil {
+			zone.AddHost(dohHost)
+		}
+		logger.Info("doh_enabled", "subdomain", dohHost)
+	}
+
 	m := &autocert.Manager{
-		Cache:      autocert.DirCache("certs"),
+		Cache:      meteringCache{autocert.DirCache("certs")},
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(host),
+		HostPolicy: autocert.HostWhitelist(whitelist...),
 	}
-	go http.ListenAndServe(http_addr, m.HTTPHandler(nil))
+	httpServer := &http.Server{
+		Addr:              http_addr,
+		Handler:           m.HTTPHandler(nil),
+		ReadTimeout:       httpReadTimeout,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("http_server_failed", "error", err.Error())
+		}
+	}()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/dns/leaktest", lookup)
+	if acme {
+		mux.HandleFunc("/dns/acme/present", acmePresentHandler(zone, acme_ttl))
+		mux.HandleFunc("/dns/acme/cleanup", acmeCleanupHandler(zone))
+	}
+
+	var topHandler http.Handler = mux
+	if doh {
+		dohHandle := &Handle{Store: store, Transport: "DoH", Zone: zone}
+		topHandler = dohMux(mux, dohHost, dohHandle)
+	}
+	topHandler = loggingMiddleware(topHandler)
+
+	var metricsServer *http.Server
+	if metrics_addr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metricsHandler())
+		metricsServer = &http.Server{
+			Addr:              metrics_addr,
+			Handler:           metricsMux,
+			ReadTimeout:       httpReadTimeout,
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+			WriteTimeout:      httpWriteTimeout,
+			IdleTimeout:       httpIdleTimeout,
+		}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("metrics_server_failed", "error", err.Error())
+			}
+		}()
+	}
 
 	s := &http.Server{
-		Addr:      https_addr,
-		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
-		Handler:   mux,
+		Addr:              https_addr,
+		TLSConfig:         &tls.Config{GetCertificate: m.GetCertificate},
+		Handler:           topHandler,
+		ReadTimeout:       httpReadTimeout,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+
+	var dotServer *dns.Server
+	if dot {
+		dotHandler := &Handle{Store: store, Transport: "DoT", Zone: zone}
+		tlsConfig := &tls.Config{GetCertificate: m.GetCertificate}
+		dotServer = startDoT(dot_addr, tlsConfig, dotHandler)
 	}
 
+	go func() {
+		if err := s.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			logger.Error("https_server_failed", "error", err.Error())
+		}
+	}()
+
+	startWatchdog()
+
 	sent, e := daemon.SdNotify(false, "READY=1")
 	if e != nil {
 		log.Fatal(e)
@@ -204,5 +417,18 @@ func main() {
 	if !sent {
 		log.Printf("SystemD notify NOT sent\n")
 	}
-	log.Fatal(s.ListenAndServeTLS("", ""))
+
+	drain := []func(context.Context) error{
+		udpServer.ShutdownContext,
+		tcpServer.ShutdownContext,
+		httpServer.Shutdown,
+		s.Shutdown,
+	}
+	if metricsServer != nil {
+		drain = append(drain, metricsServer.Shutdown)
+	}
+	if dotServer != nil {
+		drain = append(drain, dotServer.ShutdownContext)
+	}
+	awaitShutdown(shutdown_grace, drain...)
 }
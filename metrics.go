@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	dnsQueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dnsleak_dns_queries_total",
+		Help: "DNS queries received, labelled by transport and response code.",
+	}, []string{"transport", "rcode"})
+
+	lookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dnsleak_lookup_duration_seconds",
+		Help:    "Latency of the /dns/leaktest lookup API, by response status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"status"})
+
+	autocertRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnsleak_autocert_requests_total",
+		Help: "Certificates actually obtained or renewed by the autocert manager (counted when newly cached, not on every TLS handshake).",
+	})
+
+	asnSeen = newASNTracker(time.Minute)
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dnsleak_unique_asns_seen",
+		Help: "Unique source ASNs seen among DNS queries in the last minute.",
+	}, asnSeen.count)
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dnsleak_store_observations",
+		Help: "Total observations currently persisted in the store.",
+	}, func() float64 {
+		if store == nil {
+			return 0
+		}
+		n, err := store.Count()
+		if err != nil {
+			logger.Error("store_count_failed", "error", err.Error())
+			return 0
+		}
+		return float64(n)
+	})
+}
+
+// asnTracker keeps a rolling window of recently seen ASNs so
+// dnsleak_unique_asns_seen can report a per-minute figure without an
+// unbounded memory footprint.
+type asnTracker struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[uint]time.Time
+}
+
+func newASNTracker(window time.Duration) *asnTracker {
+	return &asnTracker{window: window, seen: make(map[uint]time.Time)}
+}
+
+func (t *asnTracker) observe(asn uint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen[asn] = time.Now()
+}
+
+func (t *asnTracker) count() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := time.Now().Add(-t.window)
+	n := 0
+	for asn, last := range t.seen {
+		if last.Before(cutoff) {
+			delete(t.seen, asn)
+			continue
+		}
+		n++
+	}
+	return float64(n)
+}
+
+// recordQueryMetric increments dnsQueriesTotal for a query of the given
+// transport that was answered (or not) with rcode.
+func recordQueryMetric(transport string, rcode int) {
+	dnsQueriesTotal.WithLabelValues(transport, dnsRcodeLabel(rcode)).Inc()
+}
+
+// noReplyRcode labels queries taken down the leak-recording path instead
+// of being answered by the zone. Over UDP/TCP/DoT they get no reply at
+// all; over DoH they get an empty NOERROR reply, which is labelled the
+// same way.
+const noReplyRcode = -1
+
+func dnsRcodeLabel(rcode int) string {
+	if rcode == noReplyRcode {
+		return "NONE"
+	}
+	return strconv.Itoa(rcode)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// awaitShutdown blocks until SIGINT/SIGTERM, then runs the drain functions
+// one after another under a single deadline, so together they get
+// gracePeriod to finish before it returns. Pass in each
+// listener's Shutdown/ShutdownContext method (*http.Server and *dns.Server
+// both have a matching signature) so nothing gets killed mid-request.
+// systemd is only told STOPPING=1 once every listener has actually
+// finished draining, so `systemctl stop` doesn't consider the process
+// stopped before it really is.
+func awaitShutdown(gracePeriod time.Duration, drain ...func(context.Context) error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	logger.Info("shutting_down", "grace_period", gracePeriod.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	for _, d := range drain {
+		if err := d(ctx); err != nil {
+			logger.Error("shutdown_failed", "error", err.Error())
+		}
+	}
+
+	if _, err := daemon.SdNotify(false, "STOPPING=1"); err != nil {
+		logger.Error("sdnotify_stopping_failed", "error", err.Error())
+	}
+}
+
+// startWatchdog pings systemd's watchdog at half the interval requested
+// via WATCHDOG_USEC, as recommended by sd_watchdog_enabled(3). It is a
+// no-op when the unit isn't configured with WatchdogSec=.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if _, err := daemon.SdNotify(false, "WATCHDOG=1"); err != nil {
+				logger.Error("sdnotify_watchdog_failed", "error", err.Error())
+			}
+		}
+	}()
+}
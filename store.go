@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Observation is a single DNS query seen for a given session token, the
+// short-lived identifier clients embed as the first label of the domain
+// they probe (e.g. "<token>.<random>.dnstest.example.com").
+type Observation struct {
+	Token      string
+	Domain     string
+	SourceIP   string
+	SourcePort int
+	Transport  string
+	QType      string
+	QClass     string
+	DNSSECOk   bool
+	Cookie     string
+	ECS        string
+	Truncated  bool
+	Timestamp  time.Time
+}
+
+// Store persists Observations in SQLite so leak samples survive restarts,
+// can be audited historically, and are shared across replicas instead of
+// living in a single process's memory.
+type Store struct {
+	db *sql.DB
+
+	// count mirrors the row count of observations. It's seeded once from
+	// the table at startup and kept current by Record, so Count
+	// never has to run a SELECT COUNT(*) against a table that, by design,
+	// grows unbounded.
+	count atomic.Int64
+}
+
+// observationColumns lists every column added to observations since it was
+// first introduced, newest last, so addMissingColumns can backfill older
+// databases in place without losing existing rows.
+var observationColumns = []string{
+	"source_port INTEGER NOT NULL DEFAULT 0",
+	"qtype TEXT NOT NULL DEFAULT ''",
+	"qclass TEXT NOT NULL DEFAULT ''",
+	"dnssec_ok INTEGER NOT NULL DEFAULT 0",
+	"cookie TEXT NOT NULL DEFAULT ''",
+	"ecs TEXT NOT NULL DEFAULT ''",
+	"truncated INTEGER NOT NULL DEFAULT 0",
+}
+
+// NewStore opens (creating if necessary) a SQLite database at path,
+// ensures the observations table exists, and backfills any columns added
+// in later versions of this schema. WAL mode plus a busy timeout let the
+// UDP/TCP/DoH/DoT handlers all call Record concurrently without hitting
+// SQLITE_BUSY instead of actually writing the observation.
+func NewStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS observations (
+		token      TEXT NOT NULL,
+		domain     TEXT NOT NULL,
+		source_ip  TEXT NOT NULL,
+		transport  TEXT NOT NULL,
+		seen_at    DATETIME NOT NULL
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := addMissingColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_observations_token ON observations(token)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var n int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM observations`).Scan(&n); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{db: db}
+	s.count.Store(n)
+	return s, nil
+}
+
+// addMissingColumns adds any column from observationColumns that isn't
+// already present in the observations table.
+func addMissingColumns(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(observations)`)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			ctype   string
+			notnull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, col := range observationColumns {
+		name := strings.Fields(col)[0]
+		if existing[name] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE observations ADD COLUMN ` + col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record inserts a new Observation.
+func (s *Store) Record(o Observation) error {
+	_, err := s.db.Exec(
+		`INSERT INTO observations
+			(token, domain, source_ip, source_port, transport, qtype, qclass, dnssec_ok, cookie, ecs, truncated, seen_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		o.Token, o.Domain, o.SourceIP, o.SourcePort, o.Transport, o.QType, o.QClass, o.DNSSECOk, o.Cookie, o.ECS, o.Truncated, o.Timestamp,
+	)
+	if err != nil {
+		return err
+	}
+	s.count.Add(1)
+	return nil
+}
+
+// Observations returns every Observation recorded for token, oldest first.
+func (s *Store) Observations(token string) ([]Observation, error) {
+	rows, err := s.db.Query(
+		`SELECT token, domain, source_ip, source_port, transport, qtype, qclass, dnssec_ok, cookie, ecs, truncated, seen_at
+			FROM observations WHERE token = ? ORDER BY seen_at`,
+		token,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Observation
+	for rows.Next() {
+		var o Observation
+		if err := rows.Scan(
+			&o.Token, &o.Domain, &o.SourceIP, &o.SourcePort, &o.Transport,
+			&o.QType, &o.QClass, &o.DNSSECOk, &o.Cookie, &o.ECS, &o.Truncated, &o.Timestamp,
+		); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// Count returns the total number of observations persisted, across every
+// token. It's maintained in memory (seeded at startup, incremented by
+// Record) rather than queried, since observations are kept forever and a
+// SELECT COUNT(*) would mean a full-table scan on every call. Rows that
+// other processes sharing the database insert after startup are not
+// included.
+func (s *Store) Count() (int64, error) {
+	return s.count.Load(), nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+)
+
+// dohSubdomain returns the host the DoH endpoint is mounted on:
+// "<label>.dnstest.<host>". label must be stable across restarts (e.g.
+// operator-configured via -doh-label) so the DoH endpoint -- and the
+// autocert certificate issued for it -- doesn't change on every launch.
+func dohSubdomain(host, label string) string {
+	return label + ".dnstest." + host
+}
+
+// tokenFromDomain extracts the client-generated session token from a
+// queried domain of the form "<token>.<random>.dnstest.example.com". It
+// is always the first label; an empty domain yields an empty token.
+func tokenFromDomain(domain string) string {
+	i := strings.IndexByte(domain, '.')
+	if i < 0 {
+		return domain
+	}
+	return domain[:i]
+}
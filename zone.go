@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// acmeRecord is a TXT value installed for an ACME DNS-01 challenge. It
+// expires ttl after being presented so a client that forgets to call
+// cleanup doesn't leave a stale challenge around forever.
+type acmeRecord struct {
+	value   string
+	expires time.Time
+}
+
+// Zone makes this server answer authoritative SOA/NS/TXT queries for host
+// and its subdomains, so it can act as the nameserver for the leak-test
+// zone (needed for glue records) and relay ACME DNS-01 challenges for
+// external tools (lego, certbot) via Present/Cleanup. A (address) answers
+// are restricted to an explicit set of infrastructure names added via
+// AddHost -- every other name under the zone is a leak-test probe
+// subdomain and must fall through to normal leak recording instead of
+// being intercepted here.
+type Zone struct {
+	host string
+	ip   net.IP
+
+	mu     sync.Mutex
+	txt    map[string]acmeRecord
+	aHosts map[string]struct{}
+}
+
+func NewZone(host string, ip net.IP) *Zone {
+	z := &Zone{host: dns.Fqdn(host), ip: ip, txt: make(map[string]acmeRecord), aHosts: make(map[string]struct{})}
+	z.aHosts[z.host] = struct{}{}
+	return z
+}
+
+// AddHost marks fqdn as an infrastructure name this zone should answer
+// authoritative A queries for, in addition to the zone apex itself (e.g.
+// the DoH endpoint's subdomain, so it resolves without being treated as a
+// leak-test probe).
+func (z *Zone) AddHost(fqdn string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.aHosts[dns.Fqdn(fqdn)] = struct{}{}
+}
+
+// Present installs a TXT value for fqdn, replacing any prior value, valid
+// for ttl.
+func (z *Zone) Present(fqdn, value string, ttl time.Duration) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.txt[dns.Fqdn(fqdn)] = acmeRecord{value: value, expires: time.Now().Add(ttl)}
+}
+
+// Cleanup removes any TXT value installed for fqdn.
+func (z *Zone) Cleanup(fqdn string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	delete(z.txt, dns.Fqdn(fqdn))
+}
+
+func (z *Zone) txtFor(fqdn string) (string, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	rec, ok := z.txt[fqdn]
+	if !ok || time.Now().After(rec.expires) {
+		return "", false
+	}
+	return rec.value, true
+}
+
+// owns reports whether fqdn falls inside the zone this server is
+// authoritative for (host itself or any subdomain of it).
+func (z *Zone) owns(fqdn string) bool {
+	return fqdn == z.host || strings.HasSuffix(fqdn, "."+z.host)
+}
+
+// soaRecord builds the zone's SOA record, used both as a direct answer to
+// an SOA query and in the Authority section of a NODATA reply.
+func (z *Zone) soaRecord() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: z.host, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:      z.host,
+		Mbox:    "hostmaster." + z.host,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// nodata builds a NOERROR/NODATA reply (RFC 2308) carrying the zone's SOA
+// in the Authority section, for names we're authoritative for but don't
+// have a record of the requested type for.
+func (z *Zone) nodata(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.Ns = append(resp.Ns, z.soaRecord())
+	return resp
+}
+
+// isInfra reports whether fqdn is the zone apex or a name added via
+// AddHost. It gates every case where this zone would otherwise answer (or
+// NODATA) a name with no actual record behind it: a leak-test probe
+// subdomain asking for some qtype we don't specially handle, or a TXT
+// query for a challenge nobody presented, must fall through to normal
+// recording (ok=false) instead of being intercepted here -- an IPv6-only
+// resolver's AAAA probe, for instance, must reach Handle.record exactly
+// like its A probe does. A presented ACME TXT challenge is answered
+// regardless of isInfra, since txtFor itself is already scoped to names
+// explicitly installed via Present.
+func (z *Zone) isInfra(fqdn string) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	_, known := z.aHosts[fqdn]
+	return known
+}
+
+// Answer builds an authoritative reply for req if it falls inside the
+// zone. SOA/NS answer for any owned name; A only for infrastructure names
+// (see isInfra); TXT answers whatever challenge was presented for that
+// exact name, regardless of isInfra. Anything else -- an unhandled qtype,
+// or a TXT query with no challenge present -- gets a NODATA reply only
+// for infrastructure names; for any other owned name (a leak-test probe
+// subdomain) it returns ok=false so the caller falls through to normal
+// leak recording instead.
+func (z *Zone) Answer(req *dns.Msg) (resp *dns.Msg, ok bool) {
+	if len(req.Question) == 0 {
+		return nil, false
+	}
+	q := req.Question[0]
+	if !z.owns(q.Name) {
+		return nil, false
+	}
+
+	resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	switch q.Qtype {
+	case dns.TypeSOA:
+		resp.Answer = append(resp.Answer, z.soaRecord())
+	case dns.TypeNS:
+		resp.Answer = append(resp.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: z.host, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+			Ns:  z.host,
+		})
+	case dns.TypeA:
+		if z.ip == nil || !z.isInfra(q.Name) {
+			return nil, false
+		}
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   z.ip,
+		})
+	case dns.TypeTXT:
+		value, found := z.txtFor(q.Name)
+		if !found {
+			if !z.isInfra(q.Name) {
+				return nil, false
+			}
+			return z.nodata(req), true
+		}
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{value},
+		})
+	default:
+		if !z.isInfra(q.Name) {
+			return nil, false
+		}
+		return z.nodata(req), true
+	}
+
+	return resp, true
+}